@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/xuwaters/gdrive/pkg/download"
+	"github.com/xuwaters/gdrive/pkg/upload"
 )
 
 func main() {
@@ -24,5 +25,6 @@ func GetCmd() *cobra.Command {
 		Use: appName,
 	}
 	cmd.AddCommand(download.GetCmd())
+	cmd.AddCommand(upload.GetCmd())
 	return cmd
 }
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const callbackPage = `<html><body><h3>Authorization complete.</h3><p>You may close this window.</p></body></html>`
+
+// LoadTokenFromWebLoopback runs a one-shot local HTTP server bound to
+// bindAddr (e.g. "127.0.0.1:0" to pick a free port), uses it as the OAuth2
+// redirect URI, and waits for the provider to redirect back with the
+// authorization code. It rejects callbacks whose state doesn't match the one
+// generated for this invocation.
+func LoadTokenFromWebLoopback(config *oauth2.Config, bindAddr string, timeout time.Duration) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on: %s, err = %w", bindAddr, err)
+	}
+
+	state, err := randomState()
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Unable to generate state token: %w", err)
+	}
+
+	// copy config so the caller's RedirectURL isn't mutated
+	loopbackConfig := *config
+	loopbackConfig.RedirectURL = fmt.Sprintf("http://%s/callback", listener.Addr().String())
+
+	type result struct {
+		token *oauth2.Token
+		err   error
+	}
+	resultCh := make(chan result, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("state") != state {
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			resultCh <- result{err: fmt.Errorf("state mismatch: got %q", query.Get("state"))}
+			return
+		}
+		code := query.Get("code")
+		if code == "" {
+			http.Error(w, "missing code", http.StatusBadRequest)
+			resultCh <- result{err: fmt.Errorf("missing code in callback: %s", r.URL)}
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		token, err := loopbackConfig.Exchange(ctx, code)
+		if err != nil {
+			http.Error(w, "token exchange failed", http.StatusInternalServerError)
+			resultCh <- result{err: fmt.Errorf("Unable to retrieve token from web: %w", err)}
+			return
+		}
+		fmt.Fprint(w, callbackPage)
+		resultCh <- result{token: token}
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+
+	authURL := loopbackConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	fmt.Printf("Open the following link in browser:\n %s\n", authURL)
+
+	select {
+	case res := <-resultCh:
+		return res.token, res.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("timed out waiting for oauth callback on %s", loopbackConfig.RedirectURL)
+	}
+}
+
+func randomState() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -1,35 +1,45 @@
 package download
 
 import (
-	"bufio"
 	"container/list"
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
+
+	"github.com/xuwaters/gdrive/pkg/auth"
+	"github.com/xuwaters/gdrive/pkg/pacer"
+	"github.com/xuwaters/gdrive/pkg/sink"
 )
 
 type downloadConfig struct {
-	CredFile  string `mapstructure:"cred_file"`
-	TokenFile string `mapstructure:"token_file"`
-	Src       string `mapstructure:"src"`
-	Dst       string `mapstructure:"dst"`
-	ListFile  string `mapstructure:"list_file"` // save file list meta
+	CredFile      string `mapstructure:"cred_file"`
+	TokenFile     string `mapstructure:"token_file"`
+	Src           string `mapstructure:"src"`
+	Dst           string `mapstructure:"dst"`
+	ListFile      string `mapstructure:"list_file"` // save file list meta
+	Sink          string `mapstructure:"sink"`      // local or s3
+	S3Bucket      string `mapstructure:"s3-bucket"`
+	S3Region      string `mapstructure:"s3-region"`
+	S3Endpoint    string `mapstructure:"s3-endpoint"`
+	S3Prefix      string `mapstructure:"s3-prefix"`
+	ExportFormats string `mapstructure:"export-formats"`
+	Concurrency   int    `mapstructure:"concurrency"`
+	AuthMode      string `mapstructure:"auth-mode"`
+	AuthBindAddr  string `mapstructure:"auth-bind-address"`
+	Incremental   bool   `mapstructure:"incremental"`
+	Delete        bool   `mapstructure:"delete"`
 }
 
 func loadConfig() (*downloadConfig, error) {
@@ -68,6 +78,17 @@ func GetCmd() *cobra.Command {
 	flags.String("dst", "", "Destination directory")
 	flags.String("token_file", "", "token file that stores access and refresh tokens, and is created automatically")
 	flags.String("list_file", "", "list of files to be downloaded, will be created automatically")
+	flags.String("sink", "local", "where downloaded files are written to: local or s3")
+	flags.String("s3-bucket", "", "s3 bucket name, required when --sink=s3")
+	flags.String("s3-region", "", "s3 region, required when --sink=s3")
+	flags.String("s3-endpoint", "", "s3-compatible endpoint override, defaults to the aws endpoint for --s3-region")
+	flags.String("s3-prefix", "", "key prefix prepended to every object written when --sink=s3")
+	flags.String("export-formats", defaultExportFormats, "extension to use per Google-native doc type, e.g. document=docx,spreadsheet=xlsx,presentation=pptx,drawing=svg,script=json")
+	flags.Int("concurrency", 4, "number of files to download in parallel")
+	flags.String("auth-mode", string(auth.AuthModeLoopback), "how to obtain a new oauth token: loopback or console")
+	flags.String("auth-bind-address", "127.0.0.1:0", "address the loopback oauth callback server binds to, when auth-mode=loopback")
+	flags.Bool("incremental", false, "sync changes since the last run via the Drive Changes API instead of re-walking the whole folder tree")
+	flags.Bool("delete", false, "when --incremental, also delete local files whose Drive source was removed or trashed")
 
 	_ = cmd.MarkFlagRequired("src")
 	_ = cmd.MarkFlagRequired("dst")
@@ -91,10 +112,35 @@ func GetCmd() *cobra.Command {
 }
 
 type Task struct {
-	FileId      string `json:"id"`
-	SavePath    string `json:"path"`
-	Md5Checksum string `json:"md5"`
-	Done        bool   `json:"done"`
+	FileId         string `json:"id"`
+	ParentId       string `json:"parent_id,omitempty"` // drive parent folder id, used to place new/renamed entries during incremental sync
+	SavePath       string `json:"path"`                // sink-relative key, e.g. local path or s3 key
+	Md5Checksum    string `json:"md5"`
+	Done           bool   `json:"done"`
+	IsDir          bool   `json:"is_dir,omitempty"`           // folder entry kept only to resolve descendants during incremental sync; never downloaded
+	ExportMimeType string `json:"export_mime_type,omitempty"` // set for Google-native docs, exported via Files.Export
+	Extension      string `json:"extension,omitempty"`        // extension appended to SavePath for exported docs
+	ModifiedTime   string `json:"modified_time,omitempty"`    // cached for exported docs, which have no md5Checksum
+}
+
+// ListFile is the on-disk schema of --list_file: the cached task tree plus
+// the Drive Changes API page token incremental sync resumes from.
+type ListFile struct {
+	StartPageToken string `json:"start_page_token,omitempty"`
+	Tasks          []Task `json:"tasks"`
+}
+
+// buildSink constructs the Sink files are downloaded into, based on
+// config.Sink.
+func buildSink(config *downloadConfig) (sink.Sink, error) {
+	switch config.Sink {
+	case "", "local":
+		return sink.NewLocalSink(config.Dst), nil
+	case "s3":
+		return sink.NewS3Sink(config.S3Bucket, config.S3Region, config.S3Endpoint, config.S3Prefix)
+	default:
+		return nil, fmt.Errorf("unknown sink: %s", config.Sink)
+	}
 }
 
 func onRunDownload(cmd *cobra.Command, args []string, config *downloadConfig) {
@@ -110,83 +156,142 @@ func onRunDownload(cmd *cobra.Command, args []string, config *downloadConfig) {
 	}
 
 	ctx := context.Background()
-	tokenSource := mustLoadTokenSource(ctx, oauth2Config, config.TokenFile)
+	tokenSource := auth.MustLoadTokenSource(ctx, oauth2Config, config.TokenFile, auth.AuthMode(config.AuthMode), config.AuthBindAddr)
 	service, err := drive.NewService(ctx, option.WithTokenSource(tokenSource))
 	if err != nil {
 		log.Printf("Unable to create google drive service, err = %v", err)
 		return
 	}
 
+	dstSink, err := buildSink(config)
+	if err != nil {
+		log.Printf("Unable to build sink, err = %v", err)
+		return
+	}
+
+	exportFormats, err := parseExportFormats(config.ExportFormats)
+	if err != nil {
+		log.Printf("Unable to parse export-formats, err = %v", err)
+		return
+	}
+
 	root := Task{
 		FileId:   config.Src,
-		SavePath: config.Dst,
+		SavePath: "",
 	}
 
-	var fileTasks []Task
-
-	fileTasks, err = loadListFile(config.ListFile)
+	lf, err := loadListFile(config.ListFile)
 	if err != nil {
 		log.Printf("Load list file err = %v", err)
-		fileTasks, err = listDriveFolderFiles(service, root)
+		tasks, err := listDriveFolderFiles(service, root, exportFormats)
 		if err != nil {
 			log.Printf("list files: err = %v", err)
 			return
 		}
+		lf = &ListFile{Tasks: tasks}
 		// save lists
-		_ = saveListFile(fileTasks, config.ListFile)
+		_ = saveListFile(lf, config.ListFile)
+	}
+
+	if config.Incremental {
+		if err := syncIncrementalChanges(service, lf, config.Delete, dstSink, exportFormats); err != nil {
+			log.Printf("incremental sync: err = %v", err)
+			return
+		}
+		_ = saveListFile(lf, config.ListFile)
 	}
 
+	fileTasks := lf.Tasks
 	total := len(fileTasks)
 	log.Printf("Total files: %d", total)
 
-	for i, task := range fileTasks {
-		if task.Done {
-			log.Printf("Skipping: %05d / %05d, file: %s", i, total, task.SavePath)
-			continue
-		}
-		percent := float64(i) * 100.0 / float64(total)
-		log.Printf("Downloading: %05d / %05d (%.2f %%)", i, total, percent)
-		for k := 1; k <= 5; k++ {
-			err = downloadDriveFile(service, task)
-			if err == nil {
-				break
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sharedPacer := pacer.New()
+	var listMu sync.Mutex
+	var fatalErr error
+	var fatalOnce sync.Once
+
+	taskIndexes := make(chan int)
+	go func() {
+		defer close(taskIndexes)
+		for i, task := range fileTasks {
+			// Export tasks are always re-enqueued: downloadDriveFile checks
+			// the live modifiedTime and only re-exports when it changed, so
+			// Done alone can't gate them the way it does plain downloads.
+			if task.Done && task.ExportMimeType == "" {
+				log.Printf("Skipping: %05d / %05d, file: %s", i, total, task.SavePath)
+				continue
+			}
+			select {
+			case taskIndexes <- i:
+			case <-ctx.Done():
+				return
 			}
-			sleepDuration := time.Duration(k*5) * time.Second
-			log.Printf("retry [%02d] in %v, err = %v", k, sleepDuration, err)
-			time.Sleep(sleepDuration)
-		}
-		if err != nil {
-			log.Printf("download err = %v", err)
-			break
 		}
-		fileTasks[i].Done = true
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range taskIndexes {
+				task := fileTasks[i]
+				var modifiedTime string
+				err := sharedPacer.Call(func() error {
+					var err error
+					modifiedTime, err = downloadDriveFile(ctx, service, dstSink, task)
+					return err
+				})
+				if err != nil {
+					log.Printf("download err = %v, file: %s", err, task.SavePath)
+					fatalOnce.Do(func() {
+						fatalErr = err
+						cancel()
+					})
+					continue
+				}
 
-		// save list file periodically
-		if (i+1)%10 == 0 {
-			_ = saveListFile(fileTasks, config.ListFile)
-		}
+				listMu.Lock()
+				fileTasks[i].Done = true
+				if modifiedTime != "" {
+					fileTasks[i].ModifiedTime = modifiedTime
+				}
+				_ = saveListFile(lf, config.ListFile)
+				listMu.Unlock()
+			}
+		}()
 	}
+	wg.Wait()
 
-	// save list file
-	_ = saveListFile(fileTasks, config.ListFile)
+	if fatalErr != nil {
+		log.Printf("download stopped after fatal error = %v", fatalErr)
+	}
 }
 
-func loadListFile(listFile string) ([]Task, error) {
+func loadListFile(listFile string) (*ListFile, error) {
 	fin, err := os.Open(listFile)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to open list file: %s, err = %w", listFile, err)
 	}
 	defer fin.Close()
-	var tasks []Task
+	lf := &ListFile{}
 	decoder := json.NewDecoder(fin)
-	err = decoder.Decode(&tasks)
+	err = decoder.Decode(lf)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to decode list file: %s, err = %w", listFile, err)
 	}
-	return tasks, nil
+	return lf, nil
 }
 
-func saveListFile(fileTasks []Task, listFile string) error {
+func saveListFile(lf *ListFile, listFile string) error {
 	fout, err := os.Create(listFile)
 	if err != nil {
 		return fmt.Errorf("Unable create list file: %s, err = %w", listFile, err)
@@ -195,7 +300,7 @@ func saveListFile(fileTasks []Task, listFile string) error {
 
 	encoder := json.NewEncoder(fout)
 	encoder.SetIndent("", "  ")
-	err = encoder.Encode(fileTasks)
+	err = encoder.Encode(lf)
 	if err != nil {
 		return fmt.Errorf("Marshal tasks err = %w", err)
 	}
@@ -203,7 +308,7 @@ func saveListFile(fileTasks []Task, listFile string) error {
 	return nil
 }
 
-func listDriveFolderFiles(service *drive.Service, rootFolder Task) ([]Task, error) {
+func listDriveFolderFiles(service *drive.Service, rootFolder Task, exportFormats map[string]string) ([]Task, error) {
 	fileTasks := []Task{}
 	taskQueue := list.New()
 	taskQueue.PushBack(rootFolder)
@@ -213,20 +318,18 @@ func listDriveFolderFiles(service *drive.Service, rootFolder Task) ([]Task, erro
 		task := frontElem.Value.(Task)
 		// get meta data
 		driveFile := service.Files.Get(task.FileId)
-		currFile, err := driveFile.Fields("id,name,mimeType,md5Checksum").Do()
+		currFile, err := driveFile.Fields("id,name,mimeType,md5Checksum,modifiedTime").Do()
 		if err != nil {
 			return nil, fmt.Errorf("get fileId: %s, err = %v", task.FileId, err)
 		}
 		if isDriveFolder(currFile) {
+			// register the folder itself, so incremental sync can later
+			// resolve it as a known ancestor when placing new changes
+			fileTasks = append(fileTasks, Task{FileId: currFile.Id, ParentId: task.ParentId, SavePath: task.SavePath, IsDir: true, Done: true})
 			// list folder contents
 			log.Printf(">> list folder: %s [%s]", currFile.Id, currFile.Name)
 			err = listDriveFolder(service, currFile.Id, func(nextFile *drive.File) error {
-				dstFilePath := filepath.Join(task.SavePath, nextFile.Name)
-				nextTask := Task{
-					FileId:      nextFile.Id,
-					SavePath:    dstFilePath,
-					Md5Checksum: nextFile.Md5Checksum,
-				}
+				nextTask := makeTask(task.SavePath, currFile.Id, nextFile, exportFormats)
 				if isDriveFolder(nextFile) {
 					taskQueue.PushBack(nextTask)
 				} else {
@@ -239,17 +342,48 @@ func listDriveFolderFiles(service *drive.Service, rootFolder Task) ([]Task, erro
 			}
 		} else {
 			// download file
-			dstFilePath := filepath.Join(task.SavePath, currFile.Name)
-			fileTasks = append(fileTasks, Task{
-				FileId:      currFile.Id,
-				SavePath:    dstFilePath,
-				Md5Checksum: currFile.Md5Checksum,
-			})
+			fileTasks = append(fileTasks, makeTask(task.SavePath, task.ParentId, currFile, exportFormats))
 		}
 	}
 	return fileTasks, nil
 }
 
+// makeTask builds the Task for driveFile, which lives under parentSavePath
+// and whose Drive parent folder id is parentId. Folders get an IsDir task
+// that is already marked Done, since folders are only ever walked, never
+// downloaded themselves. Google-native docs (Docs/Sheets/Slides/Drawings/
+// Apps Script) are exported via exportTarget instead of downloaded
+// directly; they carry no md5Checksum so their cached ModifiedTime is used
+// to decide when to re-export instead.
+func makeTask(parentSavePath, parentId string, driveFile *drive.File, exportFormats map[string]string) Task {
+	savePath := filepath.Join(parentSavePath, driveFile.Name)
+	if isDriveFolder(driveFile) {
+		return Task{
+			FileId:   driveFile.Id,
+			ParentId: parentId,
+			SavePath: savePath,
+			IsDir:    true,
+			Done:     true,
+		}
+	}
+	if ext, exportMimeType, ok := exportTarget(driveFile.MimeType, exportFormats); ok {
+		return Task{
+			FileId:         driveFile.Id,
+			ParentId:       parentId,
+			SavePath:       savePath + "." + ext,
+			ExportMimeType: exportMimeType,
+			Extension:      ext,
+			ModifiedTime:   driveFile.ModifiedTime,
+		}
+	}
+	return Task{
+		FileId:      driveFile.Id,
+		ParentId:    parentId,
+		SavePath:    savePath,
+		Md5Checksum: driveFile.Md5Checksum,
+	}
+}
+
 func listDriveFolder(service *drive.Service, folderId string, handler func(*drive.File) error) error {
 	pageToken := ""
 	for i := 0; ; i++ {
@@ -260,7 +394,7 @@ func listDriveFolder(service *drive.Service, folderId string, handler func(*driv
 			Spaces("drive").
 			Corpora("user").
 			Q(fmt.Sprintf("'%s' in parents", folderId)).
-			Fields("nextPageToken, files(id,name,mimeType,md5Checksum)").
+			Fields("nextPageToken, files(id,name,mimeType,md5Checksum,modifiedTime)").
 			Do()
 		if err != nil {
 			return fmt.Errorf("Unable to list files, err = %w", err)
@@ -284,126 +418,61 @@ func listDriveFolder(service *drive.Service, folderId string, handler func(*driv
 	return nil
 }
 
-func downloadDriveFile(service *drive.Service, task Task) error {
-	driveFile := service.Files.Get(task.FileId)
-	// check md5
-	dstFilePath := task.SavePath
-	dstFileMd5 := getFileMd5(dstFilePath)
-	if task.Md5Checksum != "" && dstFileMd5 != "" && dstFileMd5 == task.Md5Checksum {
-		log.Printf("skipping identical file: %s", dstFilePath)
-		return nil
-	}
-	log.Printf("downloading file (%s): %s", task.Md5Checksum, dstFilePath)
-	resp, err := driveFile.Download()
-	if err != nil {
-		return fmt.Errorf("download file: %s, err = %w", dstFilePath, err)
-	}
-	err = saveFile(dstFilePath, resp.Body)
-	if err != nil {
-		return fmt.Errorf("save file: %s, err = %w", dstFilePath, err)
-	}
-	return nil
-}
-
-func isDriveFolder(driveFile *drive.File) bool {
-	return strings.HasSuffix(driveFile.MimeType, "folder")
-}
-
-func getFileMd5(dstFilePath string) string {
-	checksum := md5.New()
-	fin, err := os.Open(dstFilePath)
-	if err != nil {
-		return ""
-	}
-	defer fin.Close()
-
-	buff := make([]byte, 64*1024)
-	for {
-		n, err := fin.Read(buff)
-		if err == io.EOF {
-			break
+// downloadDriveFile downloads (or exports) task, returning the
+// modifiedTime to cache for it. For export tasks the caller must persist
+// the returned value into Task.ModifiedTime so the next run can skip the
+// export when the doc is unchanged.
+func downloadDriveFile(ctx context.Context, service *drive.Service, dstSink sink.Sink, task Task) (string, error) {
+	relPath := task.SavePath
+
+	if task.ExportMimeType != "" {
+		// Google-native docs have no md5Checksum, so there is nothing to
+		// compare against Head here; check the live modifiedTime against
+		// the value cached in the list file and, once the doc has been
+		// exported (task.Done), only re-export if it changed.
+		currFile, err := service.Files.Get(task.FileId).Fields("modifiedTime").Do()
+		if err != nil {
+			return "", fmt.Errorf("get file: %s, err = %w", relPath, err)
 		}
-		_, _ = checksum.Write(buff[:n])
-	}
-	return hex.EncodeToString(checksum.Sum(nil))
-}
-
-func saveFile(dstFilePath string, reader io.ReadCloser) error {
-	defer reader.Close()
-
-	_ = os.MkdirAll(filepath.Dir(dstFilePath), 0755)
-
-	fout, err := os.Create(dstFilePath)
-	if err != nil {
-		return fmt.Errorf("Unable to create file: %s, err = %w", dstFilePath, err)
-	}
-	defer fout.Close()
-
-	writer := bufio.NewWriterSize(fout, 1024*1024)
-	defer writer.Flush()
-
-	_, err = io.Copy(writer, reader)
-	if err != nil {
-		return fmt.Errorf("Unable to write file: %s, err = %w", dstFilePath, err)
-	}
-	return nil
-}
-
-func mustLoadTokenSource(ctx context.Context, config *oauth2.Config, tokenFile string) oauth2.TokenSource {
-	// read token file
-	token, err := loadTokenFromFile(tokenFile)
-	if err != nil {
-		token, err = loadTokenFromWeb(config, 10*time.Second)
+		if task.Done && task.ModifiedTime != "" && task.ModifiedTime == currFile.ModifiedTime {
+			log.Printf("skipping unchanged doc: %s", relPath)
+			return currFile.ModifiedTime, nil
+		}
+		log.Printf("exporting file (%s) as %s: %s", task.FileId, task.ExportMimeType, relPath)
+		resp, err := service.Files.Export(task.FileId, task.ExportMimeType).Download()
 		if err != nil {
-			log.Fatalf("load token err = %v", err)
+			return "", fmt.Errorf("export file: %s, err = %w", relPath, err)
 		}
-		if err = saveToken(tokenFile, token); err != nil {
-			log.Fatalf("save token err = %v", err)
+		defer resp.Body.Close()
+		if err = dstSink.Put(ctx, relPath, resp.Body, resp.ContentLength, ""); err != nil {
+			return "", fmt.Errorf("save file: %s, err = %w", relPath, err)
 		}
+		return currFile.ModifiedTime, nil
 	}
-	log.Printf("token loaded: %s", token.TokenType)
-	return config.TokenSource(ctx, token)
-}
 
-func saveToken(tokenFile string, token *oauth2.Token) error {
-	fout, err := os.Create(tokenFile)
+	driveFile := service.Files.Get(task.FileId)
+	// check md5
+	_, dstMd5, err := dstSink.Head(relPath)
 	if err != nil {
-		return fmt.Errorf("Save token to file: %s, err = %w", tokenFile, err)
+		return "", fmt.Errorf("head sink entry: %s, err = %w", relPath, err)
 	}
-	defer fout.Close()
-	err = json.NewEncoder(fout).Encode(token)
+	if task.Md5Checksum != "" && dstMd5 != "" && dstMd5 == task.Md5Checksum {
+		log.Printf("skipping identical file: %s", relPath)
+		return "", nil
+	}
+	log.Printf("downloading file (%s): %s", task.Md5Checksum, relPath)
+	resp, err := driveFile.Download()
 	if err != nil {
-		return fmt.Errorf("Encode token to file: %s, err = %w", tokenFile, err)
+		return "", fmt.Errorf("download file: %s, err = %w", relPath, err)
 	}
-	return nil
-}
-
-func loadTokenFromFile(tokenFile string) (*oauth2.Token, error) {
-	fin, err := os.Open(tokenFile)
+	defer resp.Body.Close()
+	err = dstSink.Put(ctx, relPath, resp.Body, resp.ContentLength, task.Md5Checksum)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("save file: %s, err = %w", relPath, err)
 	}
-	defer fin.Close()
-
-	token := &oauth2.Token{}
-	err = json.NewDecoder(fin).Decode(token)
-	return token, err
+	return "", nil
 }
 
-func loadTokenFromWeb(config *oauth2.Config, timeout time.Duration) (*oauth2.Token, error) {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Open the following link in browser:\n %s\n", authURL)
-	fmt.Printf("Then type the authorization code: ")
-
-	authCode := ""
-	if _, err := fmt.Scan(&authCode); err != nil {
-		return nil, fmt.Errorf("Unable to read authorization code: %w", err)
-	}
-	ctx, ctxCancel := context.WithTimeout(context.Background(), timeout)
-	defer ctxCancel()
-	token, err := config.Exchange(ctx, authCode)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to retrieve token from web: %w", err)
-	}
-	return token, nil
+func isDriveFolder(driveFile *drive.File) bool {
+	return strings.HasSuffix(driveFile.MimeType, "folder")
 }
@@ -0,0 +1,76 @@
+package download
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nativeGoogleMimeTypes maps the Google-native MIME types that have no
+// md5Checksum and cannot be fetched via Files.Get(...).Download() to the
+// category name used in --export-formats.
+var nativeGoogleMimeTypes = map[string]string{
+	"application/vnd.google-apps.document":     "document",
+	"application/vnd.google-apps.spreadsheet":  "spreadsheet",
+	"application/vnd.google-apps.presentation": "presentation",
+	"application/vnd.google-apps.drawing":      "drawing",
+	"application/vnd.google-apps.script":       "script",
+}
+
+// exportMimeTypesByExtension maps a file extension (as used in
+// --export-formats) to the MIME type passed to Files.Export.
+var exportMimeTypesByExtension = map[string]string{
+	"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"odt":  "application/vnd.oasis.opendocument.text",
+	"ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	"odp":  "application/vnd.oasis.opendocument.presentation",
+	"pdf":  "application/pdf",
+	"svg":  "image/svg+xml",
+	"png":  "image/png",
+	"json": "application/vnd.google-apps.script+json",
+	"txt":  "text/plain",
+}
+
+const defaultExportFormats = "document=docx,spreadsheet=xlsx,presentation=pptx,drawing=svg,script=json"
+
+// parseExportFormats parses a spec like
+// "document=docx,spreadsheet=xlsx,presentation=pptx,drawing=svg,script=json"
+// into a category -> extension map.
+func parseExportFormats(spec string) (map[string]string, error) {
+	if spec == "" {
+		spec = defaultExportFormats
+	}
+	formats := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid export format entry: %q", pair)
+		}
+		category, ext := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if _, ok := exportMimeTypesByExtension[ext]; !ok {
+			return nil, fmt.Errorf("unknown export extension: %q", ext)
+		}
+		formats[category] = ext
+	}
+	return formats, nil
+}
+
+// exportTarget resolves the export extension and MIME type for a native
+// Google file, given the configured --export-formats mapping. ok is false
+// for non-native files or native files with no configured format.
+func exportTarget(mimeType string, formats map[string]string) (extension string, exportMimeType string, ok bool) {
+	category, isNative := nativeGoogleMimeTypes[mimeType]
+	if !isNative {
+		return "", "", false
+	}
+	ext, configured := formats[category]
+	if !configured {
+		return "", "", false
+	}
+	return ext, exportMimeTypesByExtension[ext], true
+}
@@ -0,0 +1,100 @@
+// Package pacer implements a shared rate limiter for the Google Drive API,
+// modeled on rclone's drive backend pacer: every caller sleeps for a common
+// interval before each request, and that interval grows on rate-limit/server
+// errors and decays back down on success.
+package pacer
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	minSleep          = 10 * time.Millisecond
+	maxSleep          = 2 * time.Second
+	decayConstant     = 2
+	perRequestTimeout = 2 * time.Minute
+)
+
+// Pacer serializes the pacing interval used by every concurrent caller; the
+// interval itself is shared state, so one Pacer should be used for all
+// requests against a single Drive service.
+type Pacer struct {
+	mu        sync.Mutex
+	sleepTime time.Duration
+}
+
+func New() *Pacer {
+	return &Pacer{sleepTime: minSleep}
+}
+
+func (p *Pacer) duration() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sleepTime
+}
+
+func (p *Pacer) grow() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sleepTime *= 2
+	if p.sleepTime > maxSleep {
+		p.sleepTime = maxSleep
+	}
+}
+
+func (p *Pacer) decay() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sleepTime /= decayConstant
+	if p.sleepTime < minSleep {
+		p.sleepTime = minSleep
+	}
+}
+
+// Call invokes fn, sleeping for the shared pacing interval beforehand. On a
+// retryable error (see ShouldRetry) the interval doubles (capped at
+// maxSleep) and fn is retried until it succeeds, returns a non-retryable
+// error, or perRequestTimeout has elapsed since the first attempt. On
+// success the interval decays back toward minSleep.
+func (p *Pacer) Call(fn func() error) error {
+	deadline := time.Now().Add(perRequestTimeout)
+	for {
+		time.Sleep(p.duration())
+		err := fn()
+		if err == nil {
+			p.decay()
+			return nil
+		}
+		if !ShouldRetry(err) || time.Now().After(deadline) {
+			return err
+		}
+		p.grow()
+	}
+}
+
+// ShouldRetry reports whether err looks like a transient Drive API error:
+// HTTP 429/5xx, or a 403 whose reason is userRateLimitExceeded or
+// rateLimitExceeded. Callers such as pkg/download wrap errors with
+// fmt.Errorf's %w, so this unwraps with errors.As rather than a bare type
+// assertion.
+func ShouldRetry(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false
+	}
+	if gerr.Code == 429 || gerr.Code >= 500 {
+		return true
+	}
+	if gerr.Code == 403 {
+		for _, item := range gerr.Errors {
+			if item.Reason == "userRateLimitExceeded" || item.Reason == "rateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
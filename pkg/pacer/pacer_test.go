@@ -0,0 +1,42 @@
+package pacer
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestShouldRetryUnwrapsWrappedError(t *testing.T) {
+	gerr := &googleapi.Error{Code: 429}
+	wrapped := fmt.Errorf("list changes: %w", gerr)
+
+	if !ShouldRetry(wrapped) {
+		t.Fatalf("ShouldRetry(%v) = false, want true", wrapped)
+	}
+}
+
+func TestShouldRetryRateLimitReason(t *testing.T) {
+	gerr := &googleapi.Error{
+		Code:   403,
+		Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}},
+	}
+	wrapped := fmt.Errorf("download file: %w", gerr)
+
+	if !ShouldRetry(wrapped) {
+		t.Fatalf("ShouldRetry(%v) = false, want true", wrapped)
+	}
+}
+
+func TestShouldRetryNonRetryable(t *testing.T) {
+	gerr := &googleapi.Error{Code: 404}
+	wrapped := fmt.Errorf("get file: %w", gerr)
+
+	if ShouldRetry(wrapped) {
+		t.Fatalf("ShouldRetry(%v) = true, want false", wrapped)
+	}
+
+	if ShouldRetry(fmt.Errorf("not a googleapi error")) {
+		t.Fatal("ShouldRetry(non-googleapi error) = true, want false")
+	}
+}
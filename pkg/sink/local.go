@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// LocalSink writes files beneath RootDir on the local filesystem, joining
+// the sink-relative path with RootDir using the OS path separator.
+type LocalSink struct {
+	RootDir string
+}
+
+func NewLocalSink(rootDir string) *LocalSink {
+	return &LocalSink{RootDir: rootDir}
+}
+
+func (s *LocalSink) resolve(relPath string) string {
+	return filepath.Join(s.RootDir, relPath)
+}
+
+func (s *LocalSink) Put(ctx context.Context, relPath string, r io.Reader, size int64, md5Checksum string) error {
+	dstFilePath := s.resolve(relPath)
+
+	_ = os.MkdirAll(filepath.Dir(dstFilePath), 0755)
+
+	fout, err := os.Create(dstFilePath)
+	if err != nil {
+		return fmt.Errorf("Unable to create file: %s, err = %w", dstFilePath, err)
+	}
+	defer fout.Close()
+
+	writer := bufio.NewWriterSize(fout, 1024*1024)
+	defer writer.Flush()
+
+	_, err = io.Copy(writer, r)
+	if err != nil {
+		return fmt.Errorf("Unable to write file: %s, err = %w", dstFilePath, err)
+	}
+	return nil
+}
+
+func (s *LocalSink) Head(relPath string) (int64, string, error) {
+	dstFilePath := s.resolve(relPath)
+
+	info, err := os.Stat(dstFilePath)
+	if err != nil {
+		return 0, "", nil
+	}
+
+	fin, err := os.Open(dstFilePath)
+	if err != nil {
+		return 0, "", nil
+	}
+	defer fin.Close()
+
+	checksum := md5.New()
+	buff := make([]byte, 64*1024)
+	for {
+		n, err := fin.Read(buff)
+		if err == io.EOF {
+			break
+		}
+		_, _ = checksum.Write(buff[:n])
+	}
+	return info.Size(), hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+func (s *LocalSink) Remove(relPath string) error {
+	err := os.Remove(s.resolve(relPath))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to remove file: %s, err = %w", s.resolve(relPath), err)
+	}
+	return nil
+}
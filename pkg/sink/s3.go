@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"golang.org/x/net/context"
+)
+
+// s3Md5MetadataKey stores the content md5Checksum as S3 object metadata.
+// The object's ETag can't be used for this: s3manager multipart-uploads
+// anything at or above s3manager.DefaultUploadPartSize (5 MiB), and a
+// multipart object's ETag is "<hash>-<partCount>", not its content MD5.
+const s3Md5MetadataKey = "md5checksum"
+
+// S3Sink streams files into an S3 (or S3-compatible) bucket using
+// s3manager's multipart uploader, so arbitrarily large Drive files can be
+// mirrored without buffering them on local disk.
+type S3Sink struct {
+	Bucket string
+	Prefix string
+
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+// NewS3Sink builds an S3Sink for bucket in region, optionally pointing at a
+// custom endpoint (e.g. for S3-compatible object stores). endpoint may be
+// empty to use the default AWS endpoint for region.
+func NewS3Sink(bucket, region, endpoint, prefix string) (*S3Sink, error) {
+	awsConfig := aws.NewConfig().WithRegion(region)
+	if endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create aws session, err = %w", err)
+	}
+	return &S3Sink{
+		Bucket:   bucket,
+		Prefix:   prefix,
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (s *S3Sink) key(relPath string) string {
+	if s.Prefix == "" {
+		return relPath
+	}
+	return path.Join(s.Prefix, relPath)
+}
+
+func (s *S3Sink) Put(ctx context.Context, relPath string, r io.Reader, size int64, md5Checksum string) error {
+	key := s.key(relPath)
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	}
+	if md5Checksum != "" {
+		input.Metadata = map[string]*string{
+			s3Md5MetadataKey: aws.String(md5Checksum),
+		}
+	}
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		return fmt.Errorf("Unable to upload to s3://%s/%s, err = %w", s.Bucket, key, err)
+	}
+	return nil
+}
+
+func (s *S3Sink) Head(relPath string) (int64, string, error) {
+	key := s.key(relPath)
+	resp, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return 0, "", nil
+		}
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return 0, "", nil
+		}
+		return 0, "", fmt.Errorf("Unable to head s3://%s/%s, err = %w", s.Bucket, key, err)
+	}
+	md5Checksum := ""
+	for k, v := range resp.Metadata {
+		// S3 canonicalizes user metadata key casing on the way back, so
+		// match case-insensitively rather than assuming s3Md5MetadataKey's
+		// exact casing round-trips.
+		if v != nil && strings.EqualFold(k, s3Md5MetadataKey) {
+			md5Checksum = *v
+			break
+		}
+	}
+	return aws.Int64Value(resp.ContentLength), md5Checksum, nil
+}
+
+func (s *S3Sink) Remove(relPath string) error {
+	key := s.key(relPath)
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to remove s3://%s/%s, err = %w", s.Bucket, key, err)
+	}
+	return nil
+}
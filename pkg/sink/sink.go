@@ -0,0 +1,28 @@
+// Package sink abstracts the destination a downloaded Drive file is written
+// to, so pkg/download can mirror a Drive folder onto local disk or into
+// object storage without branching on the destination type.
+package sink
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// Sink is a place files can be written to and inspected, keyed by a
+// sink-relative path (e.g. a local file path or an S3 key).
+type Sink interface {
+	// Put streams r (size bytes long) to relPath. md5 is the expected
+	// md5Checksum of the content, passed through for sinks that want to
+	// verify or tag the object on write.
+	Put(ctx context.Context, relPath string, r io.Reader, size int64, md5 string) error
+
+	// Head returns the size and md5 of the object already stored at
+	// relPath. It returns a zero size and empty md5 (with a nil error) if
+	// relPath does not exist yet.
+	Head(relPath string) (size int64, md5 string, err error)
+
+	// Remove deletes the object at relPath. It is a no-op, not an error, if
+	// relPath does not exist.
+	Remove(relPath string) error
+}
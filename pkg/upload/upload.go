@@ -0,0 +1,373 @@
+package upload
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	"github.com/xuwaters/gdrive/pkg/auth"
+)
+
+// uploadChunkSize controls the resumable upload chunk size used for every
+// Files.Create call; 8 MiB matches the default used by Google's own clients.
+const uploadChunkSize = 8 * 1024 * 1024
+
+type uploadConfig struct {
+	CredFile     string `mapstructure:"cred_file"`
+	TokenFile    string `mapstructure:"token_file"`
+	Src          string `mapstructure:"src"`
+	Dst          string `mapstructure:"dst"`
+	ListFile     string `mapstructure:"list_file"` // save file list meta
+	AuthMode     string `mapstructure:"auth-mode"`
+	AuthBindAddr string `mapstructure:"auth-bind-address"`
+}
+
+func loadConfig() (*uploadConfig, error) {
+	err := viper.ReadInConfig()
+	if err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, fmt.Errorf("load config failure: %w", err)
+		}
+	}
+	config := &uploadConfig{}
+	err = viper.Unmarshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unmarshal config, err = %w", err)
+	}
+	log.Printf("config loaded: %#v, settings = %#v", config, viper.AllSettings())
+	return config, nil
+}
+
+func GetCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use: "upload",
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := loadConfig()
+			if err != nil {
+				log.Fatalf("load config failure, err = %#v", err)
+				return
+			}
+			onRunUpload(cmd, args, config)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.String("cred_file", "", "credentials.json file for Google Drive API from gcloud console \nhttps://console.developers.google.com/apis/library/drive.googleapis.com")
+	flags.String("src", "", "Source local directory")
+	flags.String("dst", "", "Destination folder fileId in google drive")
+	flags.String("token_file", "", "token file that stores access and refresh tokens, and is created automatically")
+	flags.String("list_file", "", "list of files to be uploaded, will be created automatically")
+	flags.String("auth-mode", string(auth.AuthModeLoopback), "how to obtain a new oauth token: loopback or console")
+	flags.String("auth-bind-address", "127.0.0.1:0", "address the loopback oauth callback server binds to, when auth-mode=loopback")
+
+	_ = cmd.MarkFlagRequired("src")
+	_ = cmd.MarkFlagRequired("dst")
+
+	err := viper.BindPFlags(flags)
+	if err != nil {
+		log.Fatalf("Unable to bind viper flags, err = %v", err)
+	}
+
+	// config file
+	viper.SetConfigName("config-upload")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath(filepath.Base(os.Args[0]))
+
+	// environment variables
+	viper.AutomaticEnv()
+	viper.SetEnvPrefix("gd")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "__", "-", "_"))
+
+	return cmd
+}
+
+// Task describes one local file or directory that needs to be mirrored to
+// Drive. Directories are uploaded first so that their FileId can be used as
+// the ParentId for their children.
+type Task struct {
+	LocalPath   string `json:"local_path"`
+	ParentId    string `json:"parent_id"`
+	FileId      string `json:"id"`
+	Md5Checksum string `json:"md5"`
+	IsDir       bool   `json:"is_dir"`
+	Done        bool   `json:"done"`
+}
+
+func onRunUpload(cmd *cobra.Command, args []string, config *uploadConfig) {
+	credBuffer, err := ioutil.ReadFile(config.CredFile)
+	if err != nil {
+		log.Printf("Unable to read client credentials file: %s, err = %v", config.CredFile, err)
+		return
+	}
+	oauth2Config, err := google.ConfigFromJSON(credBuffer, drive.DriveScope)
+	if err != nil {
+		log.Printf("Unable to parse credentials file to config, err = %v", err)
+		return
+	}
+
+	ctx := context.Background()
+	tokenSource := auth.MustLoadTokenSource(ctx, oauth2Config, config.TokenFile, auth.AuthMode(config.AuthMode), config.AuthBindAddr)
+	service, err := drive.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		log.Printf("Unable to create google drive service, err = %v", err)
+		return
+	}
+
+	var fileTasks []Task
+
+	fileTasks, err = loadListFile(config.ListFile)
+	if err != nil {
+		log.Printf("Load list file err = %v", err)
+		fileTasks, err = listLocalFiles(config.Src, config.Dst)
+		if err != nil {
+			log.Printf("list files: err = %v", err)
+			return
+		}
+		// save lists
+		_ = saveListFile(fileTasks, config.ListFile)
+	}
+
+	total := len(fileTasks)
+	log.Printf("Total files: %d", total)
+
+	for i, task := range fileTasks {
+		if task.Done {
+			log.Printf("Skipping: %05d / %05d, file: %s", i, total, task.LocalPath)
+			continue
+		}
+		percent := float64(i) * 100.0 / float64(total)
+		log.Printf("Uploading: %05d / %05d (%.2f %%)", i, total, percent)
+		for k := 1; k <= 5; k++ {
+			err = uploadTask(service, &fileTasks[i])
+			if err == nil {
+				break
+			}
+			sleepDuration := time.Duration(k*5) * time.Second
+			log.Printf("retry [%02d] in %v, err = %v", k, sleepDuration, err)
+			time.Sleep(sleepDuration)
+		}
+		if err != nil {
+			log.Printf("upload err = %v", err)
+			break
+		}
+		fileTasks[i].Done = true
+
+		// patch ParentId of any pending child tasks once a directory gets its FileId
+		if fileTasks[i].IsDir {
+			for j := range fileTasks {
+				if fileTasks[j].ParentId == fileTasks[i].LocalPath {
+					fileTasks[j].ParentId = fileTasks[i].FileId
+				}
+			}
+		}
+
+		// save list file periodically
+		if (i+1)%10 == 0 {
+			_ = saveListFile(fileTasks, config.ListFile)
+		}
+	}
+
+	// save list file
+	_ = saveListFile(fileTasks, config.ListFile)
+}
+
+// listLocalFiles walks srcDir and builds the task list in a parent-before-child
+// order so that directories are always uploaded before the files they contain.
+// ParentId is initially set to either dstFolderId (for top-level entries) or the
+// LocalPath of the parent directory; onRunUpload rewrites directory ParentIds
+// to the real Drive FileId as each directory finishes uploading.
+func listLocalFiles(srcDir string, dstFolderId string) ([]Task, error) {
+	var fileTasks []Task
+	err := filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == srcDir {
+			return nil
+		}
+		parentId := dstFolderId
+		if parent := filepath.Dir(path); parent != srcDir {
+			parentId = parent
+		}
+		if info.IsDir() {
+			fileTasks = append(fileTasks, Task{
+				LocalPath: path,
+				ParentId:  parentId,
+				IsDir:     true,
+			})
+			return nil
+		}
+		fileTasks = append(fileTasks, Task{
+			LocalPath:   path,
+			ParentId:    parentId,
+			Md5Checksum: getFileMd5(path),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk src dir: %s, err = %w", srcDir, err)
+	}
+	return fileTasks, nil
+}
+
+func loadListFile(listFile string) ([]Task, error) {
+	fin, err := os.Open(listFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open list file: %s, err = %w", listFile, err)
+	}
+	defer fin.Close()
+	var tasks []Task
+	decoder := json.NewDecoder(fin)
+	err = decoder.Decode(&tasks)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode list file: %s, err = %w", listFile, err)
+	}
+	return tasks, nil
+}
+
+func saveListFile(fileTasks []Task, listFile string) error {
+	fout, err := os.Create(listFile)
+	if err != nil {
+		return fmt.Errorf("Unable create list file: %s, err = %w", listFile, err)
+	}
+	defer fout.Close()
+
+	encoder := json.NewEncoder(fout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(fileTasks)
+	if err != nil {
+		return fmt.Errorf("Marshal tasks err = %w", err)
+	}
+
+	return nil
+}
+
+// uploadTask creates task.LocalPath on Drive under task.ParentId, filling in
+// task.FileId on success. Directories are created once; regular files are
+// skipped if an identical (by name + md5Checksum) child already exists.
+func uploadTask(service *drive.Service, task *Task) error {
+	name := filepath.Base(task.LocalPath)
+
+	existing, err := findDriveChildByName(service, task.ParentId, name)
+	if err != nil {
+		return fmt.Errorf("find existing child: %s, err = %w", task.LocalPath, err)
+	}
+
+	if task.IsDir {
+		if existing != nil && isDriveFolder(existing) {
+			task.FileId = existing.Id
+			return nil
+		}
+		folder, err := service.Files.Create(&drive.File{
+			Name:     name,
+			Parents:  []string{task.ParentId},
+			MimeType: "application/vnd.google-apps.folder",
+		}).Fields("id").Do()
+		if err != nil {
+			return fmt.Errorf("create folder: %s, err = %w", task.LocalPath, err)
+		}
+		task.FileId = folder.Id
+		return nil
+	}
+
+	if existing != nil && existing.Md5Checksum != "" && existing.Md5Checksum == task.Md5Checksum {
+		log.Printf("skipping identical file: %s", task.LocalPath)
+		task.FileId = existing.Id
+		return nil
+	}
+
+	fin, err := os.Open(task.LocalPath)
+	if err != nil {
+		return fmt.Errorf("open file: %s, err = %w", task.LocalPath, err)
+	}
+	defer fin.Close()
+
+	stat, err := fin.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file: %s, err = %w", task.LocalPath, err)
+	}
+
+	progress := newProgressUpdater(task.LocalPath, stat.Size())
+
+	uploaded, err := service.Files.Create(&drive.File{
+		Name:    name,
+		Parents: []string{task.ParentId},
+	}).Media(fin, googleapi.ChunkSize(uploadChunkSize), googleapi.WithProgressUpdater(progress)).Fields("id,md5Checksum").Do()
+	if err != nil {
+		return fmt.Errorf("upload file: %s, err = %w", task.LocalPath, err)
+	}
+	task.FileId = uploaded.Id
+	return nil
+}
+
+// newProgressUpdater returns a googleapi.ProgressUpdater that logs a progress
+// line for localPath every time the resumable upload protocol reports a chunk.
+func newProgressUpdater(localPath string, total int64) googleapi.ProgressUpdater {
+	return func(current, _ int64) {
+		percent := float64(current) * 100.0 / float64(total)
+		log.Printf("uploading: %s, %d / %d (%.2f %%)", localPath, current, total, percent)
+	}
+}
+
+// findDriveChildByName looks up a single child of parentId with the given
+// name, mirroring the reverse lookup downloadDriveFile does against its
+// destination sink. It returns nil if no such child exists.
+func findDriveChildByName(service *drive.Service, parentId string, name string) (*drive.File, error) {
+	resp, err := service.Files.List().
+		Spaces("drive").
+		Corpora("user").
+		Q(fmt.Sprintf("'%s' in parents and name = '%s' and trashed = false", parentId, escapeDriveQueryValue(name))).
+		Fields("files(id,name,mimeType,md5Checksum)").
+		Do()
+	if err != nil {
+		return nil, fmt.Errorf("list children of: %s, err = %w", parentId, err)
+	}
+	if len(resp.Files) == 0 {
+		return nil, nil
+	}
+	return resp.Files[0], nil
+}
+
+func escapeDriveQueryValue(value string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(value, "\\", "\\\\"), "'", "\\'")
+}
+
+func isDriveFolder(driveFile *drive.File) bool {
+	return strings.HasSuffix(driveFile.MimeType, "folder")
+}
+
+func getFileMd5(srcFilePath string) string {
+	checksum := md5.New()
+	fin, err := os.Open(srcFilePath)
+	if err != nil {
+		return ""
+	}
+	defer fin.Close()
+
+	buff := make([]byte, 64*1024)
+	for {
+		n, err := fin.Read(buff)
+		if err == io.EOF {
+			break
+		}
+		_, _ = checksum.Write(buff[:n])
+	}
+	return hex.EncodeToString(checksum.Sum(nil))
+}